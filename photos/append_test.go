@@ -0,0 +1,115 @@
+package photos
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	photoslibrary "google.golang.org/api/photoslibrary/v1"
+)
+
+// batchCreateServer answers MediaItems.BatchCreate calls by reporting every
+// item successful and remembering how many items each call carried, so
+// tests can assert on how Append split its input into batches.
+type batchCreateServer struct {
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (s *batchCreateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req photoslibrary.BatchCreateMediaItemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.sizes = append(s.sizes, len(req.NewMediaItems))
+	s.mu.Unlock()
+
+	results := make([]*photoslibrary.NewMediaItemResult, len(req.NewMediaItems))
+	for i, item := range req.NewMediaItems {
+		results[i] = &photoslibrary.NewMediaItemResult{
+			UploadToken: item.SimpleMediaItem.UploadToken,
+			Status:      &photoslibrary.Status{Code: 0},
+			MediaItem:   &photoslibrary.MediaItem{Id: "id-" + item.SimpleMediaItem.UploadToken},
+		}
+	}
+	json.NewEncoder(w).Encode(photoslibrary.BatchCreateMediaItemsResponse{NewMediaItemResults: results})
+}
+
+func itemsWithTokens(n int) []*photoslibrary.NewMediaItem {
+	items := make([]*photoslibrary.NewMediaItem, n)
+	for i := range items {
+		items[i] = &photoslibrary.NewMediaItem{
+			SimpleMediaItem: &photoslibrary.SimpleMediaItem{UploadToken: string(rune('a' + i%26))},
+		}
+	}
+	return items
+}
+
+func newTestPhotosForAppend(t *testing.T, srv *batchCreateServer) *Photos {
+	t.Helper()
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	service, err := photoslibrary.New(&http.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = ts.URL + "/"
+
+	p := NewPhotos(&http.Client{}, service, log.New(ioutil.Discard, "", 0))
+	p.SetPacer(&Pacer{Min: 0, Max: 0, Decay: 1, MaxRetries: 0})
+	return p
+}
+
+func TestAppendSplitsIntoDefaultBatchSize(t *testing.T) {
+	srv := &batchCreateServer{}
+	p := newTestPhotosForAppend(t, srv)
+
+	const n = 120
+	result, err := p.Append(context.Background(), nil, itemsWithTokens(n))
+	if err != nil {
+		t.Fatalf("Append() = %v, want nil", err)
+	}
+	if len(result.Successful) != n {
+		t.Fatalf("len(Successful) = %d, want %d", len(result.Successful), n)
+	}
+
+	want := []int{50, 50, 20}
+	if len(srv.sizes) != len(want) {
+		t.Fatalf("batch sizes = %v, want %v", srv.sizes, want)
+	}
+	for i, size := range want {
+		if srv.sizes[i] != size {
+			t.Fatalf("batch sizes = %v, want %v", srv.sizes, want)
+		}
+	}
+}
+
+func TestAppendRespectsSetBatchSize(t *testing.T) {
+	srv := &batchCreateServer{}
+	p := newTestPhotosForAppend(t, srv)
+	p.SetBatchSize(10)
+
+	const n = 25
+	if _, err := p.Append(context.Background(), nil, itemsWithTokens(n)); err != nil {
+		t.Fatalf("Append() = %v, want nil", err)
+	}
+
+	want := []int{10, 10, 5}
+	if len(srv.sizes) != len(want) {
+		t.Fatalf("batch sizes = %v, want %v", srv.sizes, want)
+	}
+	for i, size := range want {
+		if srv.sizes[i] != size {
+			t.Fatalf("batch sizes = %v, want %v", srv.sizes, want)
+		}
+	}
+}
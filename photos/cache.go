@@ -0,0 +1,122 @@
+package photos
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// CacheEntry records what happened the last time a file with a given
+// cache key was appended to the library.
+type CacheEntry struct {
+	MediaItemID string    `json:"mediaItemId"`
+	UploadTime  time.Time `json:"uploadTime"`
+	AlbumIDs    []string  `json:"albumIds"`
+}
+
+// Cache is a JSON-backed sidecar recording which files have already been
+// uploaded, so re-running gpup over the same directory does not re-upload
+// them. It is keyed by a string combining the SHA-256 of the file's
+// contents with its size, so a file that was copied, rsynced, or merely
+// touched still dedupes against what was already sent.
+type Cache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]CacheEntry
+}
+
+// OpenCache loads the cache at path, creating an empty one if the file
+// does not exist yet.
+func OpenCache(path string) (*Cache, error) {
+	c := &Cache{path: path, entries: make(map[string]CacheEntry)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read cache file %s: %s", path, err)
+	}
+	if len(b) == 0 {
+		return c, nil
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, fmt.Errorf("Could not parse cache file %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// Lookup returns the entry recorded for key, if any.
+func (c *Cache) Lookup(key string) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+// Record stores entry under key and persists the cache to disk.
+func (c *Cache) Record(key string, entry CacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+	return c.save()
+}
+
+func (c *Cache) save() error {
+	b, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode cache file %s: %s", c.path, err)
+	}
+	if err := ioutil.WriteFile(c.path, b, 0644); err != nil {
+		return fmt.Errorf("Could not write cache file %s: %s", c.path, err)
+	}
+	return nil
+}
+
+// fileCacheKey hashes the contents of filepath and combines the digest
+// with the file's size, so a file whose contents changed without its
+// name changing is not mistaken for one already uploaded. Modification
+// time is deliberately excluded: a copy, rsync, or touch of an
+// already-uploaded file should still be recognized as a duplicate.
+func fileCacheKey(filepath string) (string, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return "", fmt.Errorf("Could not open file %s: %s", filepath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("Could not stat file %s: %s", filepath, err)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("Could not hash file %s: %s", filepath, err)
+	}
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), info.Size()), nil
+}
+
+// SetCachePath enables the upload cache, loading it from (or creating it
+// at) path.
+func (p *Photos) SetCachePath(path string) error {
+	cache, err := OpenCache(path)
+	if err != nil {
+		return err
+	}
+	p.cache = cache
+	return nil
+}
+
+// SetForce disables the upload cache's skip-if-already-uploaded check,
+// so every file is re-uploaded regardless of what the cache records.
+func (p *Photos) SetForce(force bool) {
+	p.force = force
+}
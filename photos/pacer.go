@@ -0,0 +1,125 @@
+package photos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Pacer retries a flaky operation with exponential backoff. A several-hour
+// upload loop should survive a single transient failure rather than losing
+// the file it was working on, so UploadFile and Append run their network
+// calls through a Pacer instead of failing on the first error.
+type Pacer struct {
+	// Min is the sleep before the first retry.
+	Min time.Duration
+	// Max caps how long a single sleep between retries can grow to.
+	Max time.Duration
+	// Decay is the multiplier applied to the sleep duration after each
+	// retry, e.g. 2 doubles it every time.
+	Decay float64
+	// MaxRetries is the number of retries attempted before giving up and
+	// returning the last error.
+	MaxRetries int
+}
+
+// defaultPacer is used by a freshly constructed Photos.
+func defaultPacer() *Pacer {
+	return &Pacer{
+		Min:        1 * time.Second,
+		Max:        60 * time.Second,
+		Decay:      2,
+		MaxRetries: 5,
+	}
+}
+
+// attempt performs one try of the operation. It returns whether the error
+// (if any) is worth retrying, and how long the caller asked to wait before
+// trying again (via a Retry-After header, say); a zero retryAfter means
+// the Pacer should use its own backoff schedule.
+type attempt func() (retryAfter time.Duration, retryable bool, err error)
+
+// Retry calls do until it succeeds, it reports a non-retryable error,
+// MaxRetries is exceeded, or ctx is cancelled, sleeping with exponential
+// backoff between attempts. The backoff sleep itself is cancellable, so a
+// long wait does not block a caller trying to shut down.
+func (p *Pacer) Retry(ctx context.Context, do attempt) error {
+	sleep := p.Min
+	var err error
+	var retryAfter time.Duration
+	var retryable bool
+	for i := 0; i <= p.MaxRetries; i++ {
+		retryAfter, retryable, err = do()
+		if err == nil {
+			return nil
+		}
+		if !retryable || i == p.MaxRetries {
+			return err
+		}
+
+		wait := sleep
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		sleep = time.Duration(float64(sleep) * p.Decay)
+		if sleep > p.Max {
+			sleep = p.Max
+		}
+	}
+	return err
+}
+
+// retryableHTTPError inspects an http.Response/error pair from
+// p.client.Do and reports whether it is worth retrying (429, 5xx, or a
+// network-level timeout), along with any Retry-After the server sent.
+func retryableHTTPError(res *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, true
+		}
+		return 0, false
+	}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return retryAfterDuration(res.Header.Get("Retry-After")), true
+	}
+	return 0, false
+}
+
+// retryableGoogleAPIError reports whether err, as returned by a generated
+// Google API client call such as MediaItems.BatchCreate(...).Do(), is
+// worth retrying.
+func retryableGoogleAPIError(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return 0, apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return 0, netErr.Timeout()
+	}
+	return 0, false
+}
+
+func retryAfterDuration(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
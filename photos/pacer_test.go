@@ -0,0 +1,95 @@
+package photos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testPacer() *Pacer {
+	return &Pacer{
+		Min:        time.Millisecond,
+		Max:        10 * time.Millisecond,
+		Decay:      2,
+		MaxRetries: 3,
+	}
+}
+
+func TestPacerRetrySucceedsAfterRetryableErrors(t *testing.T) {
+	p := testPacer()
+	attempts := 0
+	err := p.Retry(context.Background(), func() (time.Duration, bool, error) {
+		attempts++
+		if attempts < 3 {
+			return 0, true, errors.New("transient")
+		}
+		return 0, false, nil
+	})
+	if err != nil {
+		t.Fatalf("Retry() = %v, want nil", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestPacerRetryGivesUpAfterMaxRetries(t *testing.T) {
+	p := testPacer()
+	wantErr := errors.New("still failing")
+	attempts := 0
+	err := p.Retry(context.Background(), func() (time.Duration, bool, error) {
+		attempts++
+		return 0, true, wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("Retry() = %v, want %v", err, wantErr)
+	}
+	if want := p.MaxRetries + 1; attempts != want {
+		t.Fatalf("attempts = %d, want %d", attempts, want)
+	}
+}
+
+func TestPacerRetryStopsOnNonRetryableError(t *testing.T) {
+	p := testPacer()
+	wantErr := errors.New("permanent")
+	attempts := 0
+	err := p.Retry(context.Background(), func() (time.Duration, bool, error) {
+		attempts++
+		return 0, false, wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("Retry() = %v, want %v", err, wantErr)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", attempts)
+	}
+}
+
+func TestPacerRetryCancelledMidSleep(t *testing.T) {
+	p := &Pacer{Min: time.Hour, Max: time.Hour, Decay: 2, MaxRetries: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Retry(ctx, func() (time.Duration, bool, error) {
+			attempts++
+			return 0, true, errors.New("transient")
+		})
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Retry() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Retry() did not return promptly after ctx was cancelled")
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", attempts)
+	}
+}
@@ -0,0 +1,83 @@
+package photos
+
+import (
+	"log"
+	"net/http"
+	"sync"
+
+	photoslibrary "google.golang.org/api/photoslibrary/v1"
+)
+
+// defaultBatchSize is the number of media items sent in a single
+// MediaItems.BatchCreate call. The Photos Library API rejects requests
+// with more than 50 items, so this is also the maximum allowed value.
+const defaultBatchSize = 50
+
+// Photos is a thin wrapper around the Google Photos Library API that adds
+// the upload workflow (resumable uploads, batching, retries) gpup needs
+// on top of the generated client.
+type Photos struct {
+	client  *http.Client
+	service *photoslibrary.Service
+	log     *log.Logger
+
+	// batchSize controls how many media items are sent per BatchCreate
+	// call. It defaults to defaultBatchSize and must not exceed it.
+	batchSize int
+
+	// progress receives upload lifecycle notifications. It defaults to a
+	// no-op reporter; install one with SetProgressReporter.
+	progress ProgressReporter
+
+	// pacer retries the upload and BatchCreate calls on transient errors.
+	pacer *Pacer
+
+	// cache records which files have already been uploaded so re-running
+	// gpup over the same directory does not re-upload them. It is nil
+	// unless SetCachePath has been called.
+	cache *Cache
+	// force bypasses the cache's skip-if-already-uploaded check.
+	force bool
+
+	// pending maps the upload token of a file currently being appended
+	// to the cache key it was uploaded under, so Append can record the
+	// cache entry once BatchCreate confirms the media item was created.
+	pendingMu sync.Mutex
+	pending   map[string]string
+}
+
+// NewPhotos creates a Photos that talks to the Library API over client
+// and logs to logger.
+func NewPhotos(client *http.Client, service *photoslibrary.Service, logger *log.Logger) *Photos {
+	return &Photos{
+		client:    client,
+		service:   service,
+		log:       logger,
+		batchSize: defaultBatchSize,
+		progress:  noopProgressReporter{},
+		pacer:     defaultPacer(),
+		pending:   make(map[string]string),
+	}
+}
+
+// SetPacer overrides the retry/backoff behaviour used for upload and
+// BatchCreate calls.
+func (p *Photos) SetPacer(pacer *Pacer) {
+	if pacer == nil {
+		pacer = defaultPacer()
+	}
+	p.pacer = pacer
+}
+
+// SetBatchSize overrides the number of media items sent per BatchCreate
+// call. Values larger than defaultBatchSize are rejected by the API and
+// are clamped to it.
+func (p *Photos) SetBatchSize(n int) {
+	if n <= 0 {
+		return
+	}
+	if n > defaultBatchSize {
+		n = defaultBatchSize
+	}
+	p.batchSize = n
+}
@@ -0,0 +1,39 @@
+package photos
+
+// ProgressReporter receives notifications about the lifecycle of an
+// upload run so callers can surface progress to the user. Implementations
+// must be safe for concurrent use, since UploadFiles reports from
+// multiple upload workers at once.
+type ProgressReporter interface {
+	// Start is called once before any file is queued, with the total
+	// number of files and bytes the run is expected to upload.
+	Start(totalFiles int, totalBytes int64)
+	// FileStarted is called when a worker begins uploading path.
+	FileStarted(path string, size int64)
+	// BytesTransferred is called as chunks of path are sent, with delta
+	// being the number of bytes just transferred.
+	BytesTransferred(path string, delta int64)
+	// FileFinished is called when path has finished uploading, with err
+	// set if the upload failed.
+	FileFinished(path string, err error)
+	// Finish is called once after every file has finished.
+	Finish()
+}
+
+// noopProgressReporter is the default ProgressReporter and does nothing.
+type noopProgressReporter struct{}
+
+func (noopProgressReporter) Start(totalFiles int, totalBytes int64)    {}
+func (noopProgressReporter) FileStarted(path string, size int64)       {}
+func (noopProgressReporter) BytesTransferred(path string, delta int64) {}
+func (noopProgressReporter) FileFinished(path string, err error)       {}
+func (noopProgressReporter) Finish()                                   {}
+
+// SetProgressReporter installs reporter to receive upload progress
+// notifications. Passing nil restores the default no-op reporter.
+func (p *Photos) SetProgressReporter(reporter ProgressReporter) {
+	if reporter == nil {
+		reporter = noopProgressReporter{}
+	}
+	p.progress = reporter
+}
@@ -0,0 +1,98 @@
+package photos
+
+import (
+	"sync"
+
+	pb "github.com/cheggaaa/pb/v3"
+)
+
+// PbProgressReporter is a ProgressReporter backed by cheggaaa/pb. It shows
+// one bar per file it was told about (a finished file's bar stays on
+// screen, marked finished) plus an aggregate
+// byte-throughput bar, so CLI users see real progress instead of only log
+// lines while uploading large batches.
+type PbProgressReporter struct {
+	mu    sync.Mutex
+	pool  *pb.Pool
+	bars  map[string]*pb.ProgressBar
+	total *pb.ProgressBar
+}
+
+// NewPbProgressReporter creates a PbProgressReporter. Call Start on the
+// returned reporter (UploadFiles does this automatically) before using it.
+func NewPbProgressReporter() *PbProgressReporter {
+	return &PbProgressReporter{
+		bars: make(map[string]*pb.ProgressBar),
+	}
+}
+
+// Start implements ProgressReporter.
+func (r *PbProgressReporter) Start(totalFiles int, totalBytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.total = pb.New64(totalBytes).SetTemplateString(
+		`{{string . "prefix"}}{{counters . }} {{bar . }} {{speed . }}`,
+	).Set("prefix", "total ")
+
+	pool, err := pb.StartPool(r.total)
+	if err != nil {
+		return
+	}
+	r.pool = pool
+}
+
+// FileStarted implements ProgressReporter.
+func (r *PbProgressReporter) FileStarted(path string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool == nil {
+		return
+	}
+
+	bar := pb.New64(size).SetTemplateString(
+		`{{string . "prefix"}}{{counters . }} {{bar . }} {{percent . }}`,
+	).Set("prefix", path+" ")
+	r.pool.Add(bar)
+	bar.Start()
+	r.bars[path] = bar
+}
+
+// BytesTransferred implements ProgressReporter.
+func (r *PbProgressReporter) BytesTransferred(path string, delta int64) {
+	r.mu.Lock()
+	bar := r.bars[path]
+	total := r.total
+	r.mu.Unlock()
+
+	if bar != nil {
+		bar.Add64(delta)
+	}
+	if total != nil {
+		total.Add64(delta)
+	}
+}
+
+// FileFinished implements ProgressReporter.
+func (r *PbProgressReporter) FileFinished(path string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bar := r.bars[path]
+	if bar == nil {
+		return
+	}
+	bar.Finish()
+	delete(r.bars, path)
+}
+
+// Finish implements ProgressReporter.
+func (r *PbProgressReporter) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool == nil {
+		return
+	}
+	r.pool.Stop()
+	r.pool = nil
+}
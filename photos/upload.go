@@ -1,12 +1,18 @@
 package photos
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"sync"
+	"time"
 
 	photoslibrary "google.golang.org/api/photoslibrary/v1"
 )
@@ -15,112 +21,511 @@ const uploadConcurrency = 3
 const apiVersion = "v1"
 const basePath = "https://photoslibrary.googleapis.com/"
 
-// UploadFiles uploads the files.
+// defaultChunkSize is used when the server does not advertise a
+// chunk granularity in response to the resumable upload start request.
+const defaultChunkSize = 8 * 1024 * 1024 // 8 MiB
+
+// uploadJob is a file queued for upload, along with the cache key it was
+// looked up (and will be recorded) under, if caching is enabled.
+type uploadJob struct {
+	filepath string
+	cacheKey string
+}
+
+// UploadFiles uploads the files, skipping any that the upload cache
+// already knows about (unless SetForce(true) was called), optionally
+// adding those to album directly. album may be nil to target the
+// library.
+// Cancelling ctx makes workers skip the files still queued and lets in-flight uploads
+// abort their current chunk, so callers get a partial-success summary
+// instead of waiting for every worker to finish on its own.
 // This method tries uploading all files and ignores any error.
 // If no file could be uploaded, this method returns an empty array.
-func (p *Photos) UploadFiles(filepaths []string) []*photoslibrary.NewMediaItem {
-	uploadQueue := make(chan string, len(filepaths))
+func (p *Photos) UploadFiles(ctx context.Context, album *photoslibrary.Album, filepaths []string) []*photoslibrary.NewMediaItem {
+	jobs := make([]uploadJob, 0, len(filepaths))
 	for _, filepath := range filepaths {
-		uploadQueue <- filepath
+		if job, skip := p.cacheFilterFile(ctx, album, filepath); !skip {
+			jobs = append(jobs, job)
+		}
+	}
+
+	var totalBytes int64
+	for _, job := range jobs {
+		if info, err := os.Stat(job.filepath); err == nil {
+			totalBytes += info.Size()
+		}
+	}
+	p.progress.Start(len(jobs), totalBytes)
+
+	uploadQueue := make(chan uploadJob, len(jobs))
+	for _, job := range jobs {
+		uploadQueue <- job
 	}
 	close(uploadQueue)
-	p.log.Printf("Queued %d file(s)", len(filepaths))
+	p.log.Printf("Queued %d file(s)", len(jobs))
 
-	aggregateQueue := make(chan *photoslibrary.NewMediaItem, len(filepaths))
+	aggregateQueue := make(chan *photoslibrary.NewMediaItem, len(jobs))
 	workerGroup := new(sync.WaitGroup)
 	for i := 0; i < uploadConcurrency; i++ {
 		workerGroup.Add(1)
-		go p.uploadWorker(uploadQueue, aggregateQueue, workerGroup)
+		go p.uploadWorker(ctx, uploadQueue, aggregateQueue, workerGroup)
 	}
 	go func() {
 		workerGroup.Wait()
 		close(aggregateQueue)
 	}()
 
-	mediaItems := make([]*photoslibrary.NewMediaItem, 0, len(filepaths))
+	mediaItems := make([]*photoslibrary.NewMediaItem, 0, len(jobs))
 	for mediaItem := range aggregateQueue {
 		mediaItems = append(mediaItems, mediaItem)
 	}
+	p.progress.Finish()
 	return mediaItems
 }
 
-func (p *Photos) uploadWorker(uploadQueue chan string, aggregateQueue chan *photoslibrary.NewMediaItem, workerGroup *sync.WaitGroup) {
+// cacheFilterFile decides whether filepath should be uploaded. If the
+// cache already has an entry for it, the file is skipped, optionally
+// adding its existing media item to album, and skip is true.
+func (p *Photos) cacheFilterFile(ctx context.Context, album *photoslibrary.Album, filepath string) (job uploadJob, skip bool) {
+	job = uploadJob{filepath: filepath}
+	if p.cache == nil || p.force {
+		return job, false
+	}
+
+	key, err := fileCacheKey(filepath)
+	if err != nil {
+		p.log.Printf("Could not compute cache key for %s, uploading anyway: %s", filepath, err)
+		return job, false
+	}
+	job.cacheKey = key
+
+	entry, ok := p.cache.Lookup(key)
+	if !ok {
+		return job, false
+	}
+
+	p.log.Printf("Skipping %s: already uploaded as %s", filepath, entry.MediaItemID)
+	if album != nil && !containsString(entry.AlbumIDs, album.Id) {
+		if err := p.addToAlbum(ctx, album, entry.MediaItemID); err != nil {
+			p.log.Printf("Could not add %s to album %s: %s", filepath, album.Id, err)
+		} else {
+			entry.AlbumIDs = append(entry.AlbumIDs, album.Id)
+			if err := p.cache.Record(key, entry); err != nil {
+				p.log.Printf("Could not update cache for %s: %s", filepath, err)
+			}
+		}
+	}
+	return job, true
+}
+
+// addToAlbum adds an already-uploaded media item to album without going
+// through BatchCreate again.
+func (p *Photos) addToAlbum(ctx context.Context, album *photoslibrary.Album, mediaItemID string) error {
+	req := &photoslibrary.BatchAddMediaItemsToAlbumRequest{
+		MediaItemIds: []string{mediaItemID},
+	}
+	_, err := p.service.Albums.BatchAddMediaItems(album.Id, req).Context(ctx).Do()
+	return err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Photos) uploadWorker(ctx context.Context, uploadQueue chan uploadJob, aggregateQueue chan *photoslibrary.NewMediaItem, workerGroup *sync.WaitGroup) {
 	defer workerGroup.Done()
-	for filepath := range uploadQueue {
-		mediaItem, err := p.UploadFile(filepath)
+	for job := range uploadQueue {
+		if ctx.Err() != nil {
+			continue
+		}
+		mediaItem, err := p.UploadFile(ctx, job.filepath)
 		if err != nil {
-			p.log.Printf("Error while uploading file %s: %s", filepath, err)
+			p.log.Printf("Error while uploading file %s: %s", job.filepath, err)
 		} else {
+			if job.cacheKey != "" {
+				p.notePendingCache(mediaItem.SimpleMediaItem.UploadToken, job.cacheKey)
+			}
 			aggregateQueue <- mediaItem
 		}
 	}
 }
 
-// UploadFile uploads the file.
-func (p *Photos) UploadFile(filepath string) (*photoslibrary.NewMediaItem, error) {
-	r, err := os.Open(filepath)
+// notePendingCache remembers that uploadToken belongs to the file hashed
+// to cacheKey, so Append can record a cache entry for it once the item
+// has actually been created in the library.
+func (p *Photos) notePendingCache(uploadToken string, cacheKey string) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	p.pending[uploadToken] = cacheKey
+}
+
+// takePendingCache returns and forgets the cache key noted for
+// uploadToken, if any.
+func (p *Photos) takePendingCache(uploadToken string) (string, bool) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	key, ok := p.pending[uploadToken]
+	delete(p.pending, uploadToken)
+	return key, ok
+}
+
+// UploadFile uploads the file using the Google Photos resumable upload
+// protocol: an initial request starts the upload session, after which the
+// file is sent in fixed-size chunks so that transient failures only cost
+// the current chunk instead of the whole file. Cancelling ctx aborts the
+// request currently in flight.
+func (p *Photos) UploadFile(ctx context.Context, filepath string) (mediaItem *photoslibrary.NewMediaItem, err error) {
+	f, err := os.Open(filepath)
 	if err != nil {
 		return nil, fmt.Errorf("Could not open file %s: %s", filepath, err)
 	}
-	defer r.Close()
+	defer f.Close()
 
-	filename := path.Base(filepath)
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s%s/uploads", basePath, apiVersion), r)
+	info, err := f.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("Could not create a request for uploading file %s: %s", filepath, err)
+		return nil, fmt.Errorf("Could not stat file %s: %s", filepath, err)
 	}
-	req.Header.Add("X-Goog-Upload-File-Name", filename)
 
-	p.log.Printf("Uploading %s", filepath)
-	res, err := p.client.Do(req)
+	filename := path.Base(filepath)
+	p.progress.FileStarted(filepath, info.Size())
+	defer func() { p.progress.FileFinished(filepath, err) }()
+
+	uploadURL, chunkSize, err := p.startResumableUpload(ctx, filename, info.Size())
 	if err != nil {
-		return nil, fmt.Errorf("Could not send a request for uploading file %s: %s", filepath, err)
+		return nil, fmt.Errorf("Could not start resumable upload for file %s: %s", filepath, err)
 	}
-	defer res.Body.Close()
 
-	b, err := ioutil.ReadAll(res.Body)
+	token, err := p.uploadChunks(ctx, filepath, uploadURL, f, info.Size(), chunkSize)
 	if err != nil {
-		return nil, fmt.Errorf("Could not read the response body while uploading file %s: status=%d, %s", filepath, res.StatusCode, err)
+		return nil, fmt.Errorf("Could not upload file %s: %s", filepath, err)
 	}
-	body := string(b)
 
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("Could not upload file %s: status=%d, body=%s", filepath, res.StatusCode, body)
-	}
 	return &photoslibrary.NewMediaItem{
 		Description: filename,
 		SimpleMediaItem: &photoslibrary.SimpleMediaItem{
-			UploadToken: body,
+			UploadToken: token,
 		},
 	}, nil
 }
 
+// startResumableUpload opens a resumable upload session for filename and
+// returns the session URL together with the chunk size the server wants
+// chunks sent in.
+func (p *Photos) startResumableUpload(ctx context.Context, filename string, size int64) (string, int64, error) {
+	p.log.Printf("Uploading %s", filename)
+
+	var res *http.Response
+	retryErr := p.pacer.Retry(ctx, func() (time.Duration, bool, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s/uploads", basePath, apiVersion), nil)
+		if err != nil {
+			return 0, false, fmt.Errorf("Could not create a request for starting an upload: %s", err)
+		}
+		req.Header.Add("X-Goog-Upload-Command", "start")
+		req.Header.Add("X-Goog-Upload-Protocol", "resumable")
+		req.Header.Add("X-Goog-Upload-Content-Type", contentTypeOf(filename))
+		req.Header.Add("X-Goog-Upload-Raw-Size", strconv.FormatInt(size, 10))
+		req.Header.Add("X-Goog-Upload-File-Name", filename)
+
+		var doErr error
+		res, doErr = p.client.Do(req)
+		retryAfter, retryable := retryableHTTPError(res, doErr)
+		if doErr != nil {
+			return retryAfter, retryable, fmt.Errorf("Could not send a request for starting an upload: %s", doErr)
+		}
+		if retryable {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			return retryAfter, true, fmt.Errorf("Server error while starting an upload: status=%d", res.StatusCode)
+		}
+		return 0, false, nil
+	})
+	if retryErr != nil {
+		return "", 0, retryErr
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode != 200 {
+		return "", 0, fmt.Errorf("Could not start an upload: status=%d", res.StatusCode)
+	}
+
+	uploadURL := res.Header.Get("X-Goog-Upload-URL")
+	if uploadURL == "" {
+		return "", 0, fmt.Errorf("Server did not return an X-Goog-Upload-URL")
+	}
+
+	chunkSize := int64(defaultChunkSize)
+	if granularity := res.Header.Get("X-Goog-Upload-Chunk-Granularity"); granularity != "" {
+		if parsed, err := strconv.ParseInt(granularity, 10, 64); err == nil && parsed > 0 {
+			chunkSize = parsed
+		}
+	}
+	return uploadURL, chunkSize, nil
+}
+
+// maxChunkRecoveries caps how many times uploadChunks will fall back to
+// queryUploadStatus and retry the current chunk. Each fallback resets the
+// Pacer's own backoff, so without this cap a chunk that keeps failing for
+// a reason queryUploadStatus doesn't see (a persistent non-5xx error, say)
+// would retry forever instead of giving up per the Pacer's MaxRetries
+// contract.
+const maxChunkRecoveries = 5
+
+// uploadChunks sends the content of f to uploadURL in chunkSize pieces,
+// resuming from the last confirmed offset whenever a chunk fails to
+// upload. It returns the upload token from the finalize response. It
+// stops and returns ctx.Err() as soon as ctx is cancelled, without
+// starting another chunk.
+func (p *Photos) uploadChunks(ctx context.Context, filepath string, uploadURL string, f *os.File, size int64, chunkSize int64) (string, error) {
+	var offset int64
+	var recoveries int
+	buf := make([]byte, chunkSize)
+	for offset < size {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("Could not read chunk at offset %d: %s", offset, err)
+		}
+		chunk := buf[:n]
+		command := "upload"
+		if offset+int64(n) >= size {
+			command = "upload, finalize"
+		}
+
+		token, err := p.uploadChunk(ctx, uploadURL, chunk, offset, command)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return "", ctxErr
+			}
+			if recoveries >= maxChunkRecoveries {
+				return "", fmt.Errorf("Chunk upload failed at offset %d after %d recovery attempts: %s", offset, recoveries, err)
+			}
+			recoveries++
+
+			resumeOffset, queryErr := p.queryUploadStatus(ctx, uploadURL)
+			if queryErr != nil {
+				return "", fmt.Errorf("Chunk upload failed at offset %d and could not recover: %s (query error: %s)", offset, err, queryErr)
+			}
+			offset = resumeOffset
+			continue
+		}
+
+		p.progress.BytesTransferred(filepath, int64(n))
+		offset += int64(n)
+		if command == "upload, finalize" {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("Upload finished without receiving a finalize response")
+}
+
+// uploadChunk sends a single chunk starting at offset and returns the
+// response body, which only carries the upload token once the chunk
+// finalizes the session.
+func (p *Photos) uploadChunk(ctx context.Context, uploadURL string, chunk []byte, offset int64, command string) (string, error) {
+	var body string
+	retryErr := p.pacer.Retry(ctx, func() (time.Duration, bool, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, bytes.NewReader(chunk))
+		if err != nil {
+			return 0, false, fmt.Errorf("Could not create a request for uploading a chunk: %s", err)
+		}
+		req.Header.Add("X-Goog-Upload-Command", command)
+		req.Header.Add("X-Goog-Upload-Offset", strconv.FormatInt(offset, 10))
+
+		res, err := p.client.Do(req)
+		retryAfter, retryable := retryableHTTPError(res, err)
+		if err != nil {
+			return retryAfter, retryable, fmt.Errorf("Could not send a request for uploading a chunk: %s", err)
+		}
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return 0, false, fmt.Errorf("Could not read the response body while uploading a chunk: status=%d, %s", res.StatusCode, err)
+		}
+
+		if retryable {
+			return retryAfter, true, fmt.Errorf("Server error while uploading a chunk: status=%d, body=%s", res.StatusCode, string(b))
+		}
+		if res.StatusCode != 200 {
+			return 0, false, fmt.Errorf("Could not upload a chunk: status=%d, body=%s", res.StatusCode, string(b))
+		}
+		body = string(b)
+		return 0, false, nil
+	})
+	if retryErr != nil {
+		return "", retryErr
+	}
+	return body, nil
+}
+
+// queryUploadStatus asks the upload session how many bytes it has
+// confirmed receiving, so a failed chunk can be resumed instead of
+// restarting the whole upload.
+func (p *Photos) queryUploadStatus(ctx context.Context, uploadURL string) (int64, error) {
+	var res *http.Response
+	retryErr := p.pacer.Retry(ctx, func() (time.Duration, bool, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, nil)
+		if err != nil {
+			return 0, false, fmt.Errorf("Could not create a request for querying upload status: %s", err)
+		}
+		req.Header.Add("X-Goog-Upload-Command", "query")
+
+		var doErr error
+		res, doErr = p.client.Do(req)
+		retryAfter, retryable := retryableHTTPError(res, doErr)
+		if doErr != nil {
+			return retryAfter, retryable, fmt.Errorf("Could not send a request for querying upload status: %s", doErr)
+		}
+		if retryable {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			return retryAfter, true, fmt.Errorf("Server error while querying upload status: status=%d", res.StatusCode)
+		}
+		return 0, false, nil
+	})
+	if retryErr != nil {
+		return 0, retryErr
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode != 200 {
+		return 0, fmt.Errorf("Could not query upload status: status=%d", res.StatusCode)
+	}
+
+	received := res.Header.Get("X-Goog-Upload-Size-Received")
+	if received == "" {
+		return 0, fmt.Errorf("Server did not return X-Goog-Upload-Size-Received")
+	}
+	offset, err := strconv.ParseInt(received, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not parse X-Goog-Upload-Size-Received %q: %s", received, err)
+	}
+	return offset, nil
+}
+
+// contentTypeOf guesses the MIME type of filename from its extension,
+// falling back to a generic binary type when it is unknown.
+func contentTypeOf(filename string) string {
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// AppendResult aggregates the outcome of one or more BatchCreate calls
+// issued by Append.
+type AppendResult struct {
+	// Successful holds the media items that were added successfully.
+	Successful []*photoslibrary.NewMediaItem
+	// Failed maps the upload token of each item that failed to be added
+	// to its Description, which holds the base name of the uploaded file;
+	// the directory part of the path is not kept.
+	Failed map[string]string
+}
+
+func newAppendResult() *AppendResult {
+	return &AppendResult{
+		Failed: make(map[string]string),
+	}
+}
+
 // Append appends the items to the album or your library (if album is nil).
-// If some item(s) have been failed, this method does not return an error but prints message(s).
-// If a network error occurs, this method returns the error.
-func (p *Photos) Append(album *photoslibrary.Album, mediaItems []*photoslibrary.NewMediaItem) error {
+// mediaItems is split into batches of at most p.batchSize items, since the
+// API rejects BatchCreate calls with more than 50 items. Per-item
+// failures are recorded in the returned AppendResult rather than treated
+// as an error; only a network or API-level error aborts the call.
+// Cancelling ctx stops before starting the next batch and returns
+// ctx.Err(), leaving result populated with whatever batches already
+// completed.
+func (p *Photos) Append(ctx context.Context, album *photoslibrary.Album, mediaItems []*photoslibrary.NewMediaItem) (*AppendResult, error) {
+	result := newAppendResult()
+	for len(mediaItems) > 0 {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		batchSize := p.batchSize
+		if batchSize > len(mediaItems) {
+			batchSize = len(mediaItems)
+		}
+		batch := mediaItems[:batchSize]
+		mediaItems = mediaItems[batchSize:]
+
+		if err := p.appendBatch(ctx, album, batch, result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (p *Photos) appendBatch(ctx context.Context, album *photoslibrary.Album, mediaItems []*photoslibrary.NewMediaItem, result *AppendResult) error {
 	req := &photoslibrary.BatchCreateMediaItemsRequest{
 		NewMediaItems: mediaItems,
 	}
 	if album != nil {
 		req.AlbumId = album.Id
 	}
-	batch, err := p.service.MediaItems.BatchCreate(req).Do()
+	var batch *photoslibrary.BatchCreateMediaItemsResponse
+	err := p.pacer.Retry(ctx, func() (time.Duration, bool, error) {
+		var err error
+		batch, err = p.service.MediaItems.BatchCreate(req).Context(ctx).Do()
+		retryAfter, retryable := retryableGoogleAPIError(err)
+		return retryAfter, retryable, err
+	})
 	if err != nil {
 		return err
 	}
-	for _, result := range batch.NewMediaItemResults {
-		if result.Status.Code != 0 {
-			if mediaItem := findMediaItemByUploadToken(mediaItems, result.UploadToken); mediaItem != nil {
-				p.log.Printf("Skipped %s: %s (%d)", mediaItem.Description, result.Status.Message, result.Status.Code)
+	for _, item := range batch.NewMediaItemResults {
+		if item.Status.Code != 0 {
+			p.takePendingCache(item.UploadToken)
+			if mediaItem := findMediaItemByUploadToken(mediaItems, item.UploadToken); mediaItem != nil {
+				p.log.Printf("Skipped %s: %s (%d)", mediaItem.Description, item.Status.Message, item.Status.Code)
+				result.Failed[item.UploadToken] = mediaItem.Description
 			} else {
-				p.log.Printf("Error while adding files: %s (%d)", result.Status.Message, result.Status.Code)
+				p.log.Printf("Error while adding files: %s (%d)", item.Status.Message, item.Status.Code)
+				result.Failed[item.UploadToken] = ""
 			}
+		} else if mediaItem := findMediaItemByUploadToken(mediaItems, item.UploadToken); mediaItem != nil {
+			result.Successful = append(result.Successful, mediaItem)
+			p.recordCache(item, album)
 		}
 	}
 	return nil
 }
 
+// recordCache persists a cache entry for a newly created media item, if
+// it was uploaded from a file the cache is tracking.
+func (p *Photos) recordCache(item *photoslibrary.NewMediaItemResult, album *photoslibrary.Album) {
+	if p.cache == nil {
+		return
+	}
+	key, ok := p.takePendingCache(item.UploadToken)
+	if !ok {
+		return
+	}
+
+	entry := CacheEntry{
+		MediaItemID: item.MediaItem.Id,
+		UploadTime:  time.Now(),
+	}
+	if album != nil {
+		entry.AlbumIDs = []string{album.Id}
+	}
+	if err := p.cache.Record(key, entry); err != nil {
+		p.log.Printf("Could not update cache for %s: %s", item.MediaItem.Id, err)
+	}
+}
+
 func findMediaItemByUploadToken(mediaItems []*photoslibrary.NewMediaItem, uploadToken string) *photoslibrary.NewMediaItem {
 	for _, mediaItem := range mediaItems {
 		if mediaItem.SimpleMediaItem.UploadToken == uploadToken {
@@ -128,4 +533,4 @@ func findMediaItemByUploadToken(mediaItems []*photoslibrary.NewMediaItem, upload
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,150 @@
+package photos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redirectTransport rewrites every outgoing request to target's host,
+// leaving the method, path, and headers untouched. startResumableUpload
+// always dials the real basePath constant, so this is the only way to
+// point it at a local httptest.Server instead.
+type redirectTransport struct {
+	target string
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = "http"
+	req.URL.Host = t.target
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeUploadServer simulates just enough of the resumable upload protocol
+// to exercise chunk-failure recovery: it remembers how many bytes it has
+// received, optionally fails a chunk at a given offset a fixed number of
+// times, and answers query commands with the bytes it actually has.
+type fakeUploadServer struct {
+	mu          sync.Mutex
+	received    []byte
+	failOffsets map[int64]int
+	startCalls  int
+}
+
+func (s *fakeUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Header.Get("X-Goog-Upload-Command") {
+	case "start":
+		s.mu.Lock()
+		s.startCalls++
+		s.mu.Unlock()
+		w.Header().Set("X-Goog-Upload-URL", "http://"+r.Host+"/session")
+		w.Header().Set("X-Goog-Upload-Chunk-Granularity", "10")
+	case "query":
+		s.mu.Lock()
+		n := len(s.received)
+		s.mu.Unlock()
+		w.Header().Set("X-Goog-Upload-Size-Received", strconv.Itoa(n))
+	default:
+		offset, _ := strconv.ParseInt(r.Header.Get("X-Goog-Upload-Offset"), 10, 64)
+
+		s.mu.Lock()
+		if left := s.failOffsets[offset]; left > 0 {
+			s.failOffsets[offset] = left - 1
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		if offset == int64(len(s.received)) {
+			s.received = append(s.received, body...)
+		}
+		s.mu.Unlock()
+
+		if r.Header.Get("X-Goog-Upload-Command") == "upload, finalize" {
+			fmt.Fprint(w, "TOKEN123")
+		}
+	}
+}
+
+func newTestPhotos(client *http.Client) *Photos {
+	p := NewPhotos(client, nil, log.New(ioutil.Discard, "", 0))
+	p.SetPacer(&Pacer{Min: time.Millisecond, Max: time.Millisecond, Decay: 1, MaxRetries: 0})
+	return p
+}
+
+func TestUploadFileResumesFromQueriedOffsetAfterChunkFailure(t *testing.T) {
+	srv := &fakeUploadServer{failOffsets: map[int64]int{10: 2}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	client := &http.Client{Transport: &redirectTransport{target: ts.Listener.Addr().String()}}
+	p := newTestPhotos(client)
+
+	content := make([]byte, 25)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	f, err := ioutil.TempFile("", "upload-*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(content)
+	f.Close()
+
+	item, err := p.UploadFile(context.Background(), f.Name())
+	if err != nil {
+		t.Fatalf("UploadFile() = %v, want nil", err)
+	}
+	if item.SimpleMediaItem.UploadToken != "TOKEN123" {
+		t.Fatalf("UploadToken = %q, want %q", item.SimpleMediaItem.UploadToken, "TOKEN123")
+	}
+	if string(srv.received) != string(content) {
+		t.Fatalf("server received %q, want %q", srv.received, content)
+	}
+	if srv.startCalls != 1 {
+		t.Fatalf("startCalls = %d, want 1 (recovery must not restart the session)", srv.startCalls)
+	}
+}
+
+func TestUploadFileStopsAfterMaxChunkRecoveries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Goog-Upload-Command") {
+		case "start":
+			w.Header().Set("X-Goog-Upload-URL", "http://"+r.Host+"/session")
+			w.Header().Set("X-Goog-Upload-Chunk-Granularity", "10")
+		case "query":
+			w.Header().Set("X-Goog-Upload-Size-Received", "0")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &redirectTransport{target: ts.Listener.Addr().String()}}
+	p := newTestPhotos(client)
+
+	f, err := ioutil.TempFile("", "upload-*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(make([]byte, 25))
+	f.Close()
+
+	_, err = p.UploadFile(context.Background(), f.Name())
+	if err == nil {
+		t.Fatal("UploadFile() = nil, want an error after exceeding maxChunkRecoveries")
+	}
+}